@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"sort"
+)
+
+// Colormap maps a normalized intensity t in [0,1] to a color; jet is
+// the ramp this tool always used before -palette existed.
+type Colormap interface {
+	Color(t float64) color.RGBA
+}
+
+// jetColormap reproduces the original blue -> green -> yellow -> red ramp.
+type jetColormap struct{}
+
+func (jetColormap) Color(t float64) color.RGBA {
+	var r, g, b float64
+	switch {
+	case t < 0.25:
+		b = (t / 0.25) * 255
+	case t < 0.5:
+		b = 255 - ((t-0.25)/0.25)*255
+		g = ((t - 0.25) / 0.25) * 255
+	case t < 0.75:
+		g = 255
+		r = ((t - 0.5) / 0.25) * 255
+	default:
+		r = 255
+		g = 255 - ((t-0.75)/0.25)*255
+	}
+	return color.RGBA{uint8(math.Round(r)), uint8(math.Round(g)), uint8(math.Round(b)), 255}
+}
+
+// stopsColormap linearly interpolates between anchor colors evenly
+// spaced across [0,1].
+type stopsColormap struct {
+	stops []color.RGBA
+}
+
+func (c stopsColormap) Color(t float64) color.RGBA {
+	if t <= 0 {
+		return c.stops[0]
+	}
+	if t >= 1 {
+		return c.stops[len(c.stops)-1]
+	}
+	pos := t * float64(len(c.stops)-1)
+	i := int(pos)
+	frac := pos - float64(i)
+	a, b := c.stops[i], c.stops[i+1]
+	return color.RGBA{
+		uint8(float64(a.R) + frac*(float64(b.R)-float64(a.R))),
+		uint8(float64(a.G) + frac*(float64(b.G)-float64(a.G))),
+		uint8(float64(a.B) + frac*(float64(b.B)-float64(a.B))),
+		255,
+	}
+}
+
+func rgb(r, g, b uint8) color.RGBA { return color.RGBA{r, g, b, 255} }
+
+var (
+	viridisColormap = stopsColormap{stops: []color.RGBA{
+		rgb(68, 1, 84), rgb(72, 40, 120), rgb(62, 74, 137), rgb(49, 104, 142),
+		rgb(38, 130, 142), rgb(31, 158, 137), rgb(53, 183, 121), rgb(109, 205, 89),
+		rgb(180, 222, 44), rgb(253, 231, 37),
+	}}
+	infernoColormap = stopsColormap{stops: []color.RGBA{
+		rgb(0, 0, 4), rgb(31, 12, 72), rgb(85, 15, 109), rgb(136, 34, 106),
+		rgb(186, 54, 85), rgb(227, 89, 51), rgb(249, 140, 10), rgb(249, 201, 50),
+		rgb(252, 255, 164),
+	}}
+	magmaColormap = stopsColormap{stops: []color.RGBA{
+		rgb(0, 0, 4), rgb(28, 16, 68), rgb(79, 18, 123), rgb(129, 37, 129),
+		rgb(181, 54, 122), rgb(229, 80, 100), rgb(251, 135, 97), rgb(254, 194, 135),
+		rgb(252, 253, 191),
+	}}
+	turboColormap = stopsColormap{stops: []color.RGBA{
+		rgb(48, 18, 59), rgb(70, 107, 227), rgb(40, 187, 215), rgb(50, 221, 132),
+		rgb(161, 237, 52), rgb(241, 200, 42), rgb(245, 120, 30), rgb(204, 33, 19),
+		rgb(122, 4, 3),
+	}}
+)
+
+// colormapByName resolves the -palette flag value to a Colormap.
+func colormapByName(name string) (Colormap, error) {
+	switch name {
+	case "", "jet":
+		return jetColormap{}, nil
+	case "viridis":
+		return viridisColormap, nil
+	case "inferno":
+		return infernoColormap, nil
+	case "magma":
+		return magmaColormap, nil
+	case "turbo":
+		return turboColormap, nil
+	default:
+		return nil, fmt.Errorf("unknown palette %q (want jet, viridis, inferno, magma, or turbo)", name)
+	}
+}
+
+// Normalizer maps a raw change count to a t in [0,1] for Colormap.Color.
+type Normalizer interface {
+	Normalize(val uint32) float64
+}
+
+type linearNormalizer struct{ max uint32 }
+
+func (n linearNormalizer) Normalize(val uint32) float64 {
+	if n.max == 0 {
+		return 0
+	}
+	return float64(val) / float64(n.max)
+}
+
+type logNormalizer struct{ max uint32 }
+
+func (n logNormalizer) Normalize(val uint32) float64 {
+	denom := math.Log1p(float64(n.max))
+	if denom == 0 {
+		return 0
+	}
+	return math.Log1p(float64(val)) / denom
+}
+
+type sqrtNormalizer struct{ max uint32 }
+
+func (n sqrtNormalizer) Normalize(val uint32) float64 {
+	denom := math.Sqrt(float64(n.max))
+	if denom == 0 {
+		return 0
+	}
+	return math.Sqrt(float64(val)) / denom
+}
+
+// quantileNormalizer ranks a value against the sorted distribution of
+// nonzero values, so a handful of extreme hotspots don't wash out the rest.
+type quantileNormalizer struct {
+	sorted []uint32
+}
+
+func newQuantileNormalizer(changes [][]uint32) *quantileNormalizer {
+	var sorted []uint32
+	for _, row := range changes {
+		for _, v := range row {
+			if v > 0 {
+				sorted = append(sorted, v)
+			}
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return &quantileNormalizer{sorted: sorted}
+}
+
+func (n *quantileNormalizer) Normalize(val uint32) float64 {
+	if len(n.sorted) <= 1 {
+		return 1
+	}
+	idx := sort.Search(len(n.sorted), func(i int) bool { return n.sorted[i] >= val })
+	return float64(idx) / float64(len(n.sorted)-1)
+}
+
+// newNormalizer resolves the -normalize flag value. changes is only
+// walked for "quantile"; other modes just need maxChanges.
+func newNormalizer(mode string, changes [][]uint32, maxChanges uint32) (Normalizer, error) {
+	switch mode {
+	case "", "linear":
+		return linearNormalizer{max: maxChanges}, nil
+	case "log":
+		return logNormalizer{max: maxChanges}, nil
+	case "sqrt":
+		return sqrtNormalizer{max: maxChanges}, nil
+	case "quantile":
+		return newQuantileNormalizer(changes), nil
+	default:
+		return nil, fmt.Errorf("unknown normalize mode %q (want linear, log, sqrt, or quantile)", mode)
+	}
+}
+
+// renderColor turns one matrix cell into a final pixel color. val == 0
+// always renders as black (transparent black when alpha is enabled) so
+// untouched pixels stay out of the way. When alpha is true, opacity
+// scales with intensity so the heatmap can be laid over the base tiles.
+func renderColor(val, maxChanges uint32, cm Colormap, norm Normalizer, alpha bool) color.RGBA {
+	if val == 0 {
+		if alpha {
+			return color.RGBA{0, 0, 0, 0}
+		}
+		return color.RGBA{0, 0, 0, 255}
+	}
+	t := norm.Normalize(val)
+	c := cm.Color(t)
+	if alpha {
+		c.A = uint8(math.Round(t * 255))
+	}
+	return c
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"os"
+)
+
+const (
+	dumpMagic   = "WPHDUMP1"
+	dumpVersion = 1
+)
+
+// DumpVersion records one processed version's name and a content hash
+// of its merged image, so -resume can verify a re-rendered baseline.
+type DumpVersion struct {
+	Name string
+	Hash [32]byte
+}
+
+// DumpFile is the deserialized form of a -dump file.
+type DumpFile struct {
+	StartAbsX, StartAbsY int
+	Width, Height        int
+	Zoom                 int
+	Versions             []DumpVersion
+	Changes              [][]uint32
+}
+
+func hashCombined(img *image.RGBA) [32]byte {
+	return sha256.Sum256(img.Pix)
+}
+
+// drawTileInto composites a downloaded tile (tx, ty) into dst, clipping
+// to the [startAbsX, startAbsY)-(startAbsX+width, startAbsY+height) window.
+func drawTileInto(dst *image.RGBA, tx, ty, startAbsX, startAbsY, width, height int, src image.Image) {
+	tileRect := image.Rect(tx*TileSize, ty*TileSize, (tx+1)*TileSize, (ty+1)*TileSize)
+	targetRect := image.Rect(startAbsX, startAbsY, startAbsX+width, startAbsY+height)
+	inter := tileRect.Intersect(targetRect)
+	if inter.Empty() {
+		return
+	}
+	drawX := inter.Min.X - startAbsX
+	drawY := inter.Min.Y - startAbsY
+	srcX := inter.Min.X - tx*TileSize
+	srcY := inter.Min.Y - ty*TileSize
+	draw.Draw(dst, image.Rect(drawX, drawY, drawX+inter.Dx(), drawY+inter.Dy()), src, image.Point{srcX, srcY}, draw.Src)
+}
+
+func writeUint32(w io.Writer, v uint32) error {
+	return binary.Write(w, binary.LittleEndian, v)
+}
+
+func writeInt32(w io.Writer, v int32) error {
+	return binary.Write(w, binary.LittleEndian, v)
+}
+
+// writeDump serializes the change matrix plus enough header information
+// (bounds, zoom, processed-version list with hashes) to re-render or
+// resume later without re-downloading tiles.
+func writeDump(path string, startAbsX, startAbsY, width, height, zoom int, versions []DumpVersion, changes [][]uint32) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	f.WriteString(dumpMagic)
+	writeUint32(f, dumpVersion)
+	writeInt32(f, int32(startAbsX))
+	writeInt32(f, int32(startAbsY))
+	writeInt32(f, int32(width))
+	writeInt32(f, int32(height))
+	writeInt32(f, int32(zoom))
+	writeUint32(f, uint32(len(versions)))
+	for _, v := range versions {
+		writeUint32(f, uint32(len(v.Name)))
+		f.WriteString(v.Name)
+		f.Write(v.Hash[:])
+	}
+
+	gz := gzip.NewWriter(f)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if err := writeUint32(gz, changes[y][x]); err != nil {
+				return err
+			}
+		}
+	}
+	return gz.Close()
+}
+
+// loadDump reads a file written by writeDump.
+func loadDump(path string) (*DumpFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(dumpMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return nil, fmt.Errorf("read magic: %w", err)
+	}
+	if string(magic) != dumpMagic {
+		return nil, fmt.Errorf("not a wplace-heatmap dump file (bad magic)")
+	}
+
+	var version, startAbsX, startAbsY, width, height, zoom, numVersions int32
+	var uversion uint32
+	if err := binary.Read(f, binary.LittleEndian, &uversion); err != nil {
+		return nil, err
+	}
+	version = int32(uversion)
+	if version != dumpVersion {
+		return nil, fmt.Errorf("unsupported dump version %d", version)
+	}
+	for _, p := range []*int32{&startAbsX, &startAbsY, &width, &height, &zoom, &numVersions} {
+		if err := binary.Read(f, binary.LittleEndian, p); err != nil {
+			return nil, err
+		}
+	}
+
+	versions := make([]DumpVersion, numVersions)
+	for i := range versions {
+		var nameLen uint32
+		if err := binary.Read(f, binary.LittleEndian, &nameLen); err != nil {
+			return nil, err
+		}
+		nameBytes := make([]byte, nameLen)
+		if _, err := io.ReadFull(f, nameBytes); err != nil {
+			return nil, err
+		}
+		versions[i].Name = string(nameBytes)
+		if _, err := io.ReadFull(f, versions[i].Hash[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("open gzip payload: %w", err)
+	}
+	defer gz.Close()
+
+	changes := make([][]uint32, height)
+	for y := range changes {
+		changes[y] = make([]uint32, width)
+		for x := range changes[y] {
+			if err := binary.Read(gz, binary.LittleEndian, &changes[y][x]); err != nil {
+				return nil, fmt.Errorf("read changes[%d][%d]: %w", y, x, err)
+			}
+		}
+	}
+
+	return &DumpFile{
+		StartAbsX: int(startAbsX),
+		StartAbsY: int(startAbsY),
+		Width:     int(width),
+		Height:    int(height),
+		Zoom:      int(zoom),
+		Versions:  versions,
+		Changes:   changes,
+	}, nil
+}
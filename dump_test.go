@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestWriteLoadDumpRoundTrip(t *testing.T) {
+	f, err := os.CreateTemp("", "dump-*.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+
+	width, height := 3, 2
+	changes := [][]uint32{
+		{0, 5, 10},
+		{42, 0, 1},
+	}
+	versions := []DumpVersion{
+		{Name: "v1", Hash: [32]byte{1, 2, 3}},
+		{Name: "v2", Hash: [32]byte{4, 5, 6}},
+	}
+
+	if err := writeDump(path, 100, 200, width, height, 11, versions, changes); err != nil {
+		t.Fatalf("writeDump: %v", err)
+	}
+
+	got, err := loadDump(path)
+	if err != nil {
+		t.Fatalf("loadDump: %v", err)
+	}
+
+	if got.StartAbsX != 100 || got.StartAbsY != 200 || got.Width != width || got.Height != height || got.Zoom != 11 {
+		t.Fatalf("geometry mismatch: %+v", got)
+	}
+	if len(got.Versions) != len(versions) {
+		t.Fatalf("got %d versions, want %d", len(got.Versions), len(versions))
+	}
+	for i, v := range versions {
+		if got.Versions[i].Name != v.Name || got.Versions[i].Hash != v.Hash {
+			t.Fatalf("version %d mismatch: got %+v, want %+v", i, got.Versions[i], v)
+		}
+	}
+	for y := range changes {
+		for x := range changes[y] {
+			if got.Changes[y][x] != changes[y][x] {
+				t.Fatalf("changes[%d][%d] = %d, want %d", y, x, got.Changes[y][x], changes[y][x])
+			}
+		}
+	}
+}
+
+func TestLoadDumpRejectsBadMagic(t *testing.T) {
+	f, err := os.CreateTemp("", "dump-*.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := f.Name()
+	f.WriteString("not a dump file")
+	f.Close()
+	defer os.Remove(path)
+
+	if _, err := loadDump(path); err == nil {
+		t.Fatal("expected error for bad magic, got nil")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"sync"
+	"time"
+)
+
+// TileKey is both the unit of work for the worker pool and the dedup
+// key for in-flight coalescing.
+type TileKey struct {
+	Version string
+	Zoom    int
+	X, Y    int
+}
+
+type tileFetchResult struct {
+	Key TileKey
+	Img image.Image
+	Err error
+}
+
+// inflightCall lets concurrent requests for the same TileKey share one
+// HTTP fetch instead of racing each other.
+type inflightCall struct {
+	done chan struct{}
+	img  image.Image
+	err  error
+}
+
+// rateLimiter is a token-bucket limiter with no external dependency,
+// refilling one token every interval and blocking callers until one is
+// available.
+type rateLimiter struct {
+	tokens chan struct{}
+	stop   chan struct{}
+}
+
+func newRateLimiter(ratePerSec float64) *rateLimiter {
+	if ratePerSec <= 0 {
+		return nil
+	}
+	interval := time.Duration(float64(time.Second) / ratePerSec)
+	if interval <= 0 {
+		interval = time.Nanosecond
+	}
+	rl := &rateLimiter{
+		tokens: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				select {
+				case rl.tokens <- struct{}{}:
+				default:
+				}
+			case <-rl.stop:
+				return
+			}
+		}
+	}()
+	return rl
+}
+
+func (rl *rateLimiter) wait() {
+	if rl == nil {
+		return
+	}
+	<-rl.tokens
+}
+
+func (rl *rateLimiter) Close() {
+	if rl == nil {
+		return
+	}
+	close(rl.stop)
+}
+
+// TileFetcher downloads merged tiles through a bounded worker pool with
+// an optional rate limiter, coalescing duplicate in-flight requests.
+type TileFetcher struct {
+	cacheDir string
+	workers  int
+	limiter  *rateLimiter
+
+	mu       sync.Mutex
+	inflight map[TileKey]*inflightCall
+}
+
+// NewTileFetcher builds a fetcher backed by workers concurrent goroutines; ratePerSec <= 0 disables rate limiting.
+func NewTileFetcher(cacheDir string, workers int, ratePerSec float64) *TileFetcher {
+	if workers < 1 {
+		workers = 1
+	}
+	return &TileFetcher{
+		cacheDir: cacheDir,
+		workers:  workers,
+		limiter:  newRateLimiter(ratePerSec),
+		inflight: make(map[TileKey]*inflightCall),
+	}
+}
+
+// Close releases the fetcher's background rate-limiter goroutine.
+func (tf *TileFetcher) Close() {
+	tf.limiter.Close()
+}
+
+func (tf *TileFetcher) fetch(key TileKey) (image.Image, error) {
+	tf.mu.Lock()
+	if call, ok := tf.inflight[key]; ok {
+		tf.mu.Unlock()
+		<-call.done
+		return call.img, call.err
+	}
+	call := &inflightCall{done: make(chan struct{})}
+	tf.inflight[key] = call
+	tf.mu.Unlock()
+
+	tf.limiter.wait()
+	call.img, call.err = downloadMergedTile(key.Version, tf.cacheDir, key.Zoom, key.X, key.Y)
+
+	tf.mu.Lock()
+	delete(tf.inflight, key)
+	tf.mu.Unlock()
+	close(call.done)
+
+	return call.img, call.err
+}
+
+// FetchBatch dispatches keys across the worker pool and returns one
+// result per key, in the same order as keys. A per-tile error never
+// aborts the rest of the batch; onProgress, if non-nil, is invoked once
+// per completed tile.
+func (tf *TileFetcher) FetchBatch(keys []TileKey, onProgress func(done, total int, key TileKey, err error)) []tileFetchResult {
+	results := make([]tileFetchResult, len(keys))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var doneCount int
+	var progressMu sync.Mutex
+
+	worker := func() {
+		defer wg.Done()
+		for i := range jobs {
+			img, err := tf.fetch(keys[i])
+			results[i] = tileFetchResult{Key: keys[i], Img: img, Err: err}
+			if onProgress != nil {
+				progressMu.Lock()
+				doneCount++
+				onProgress(doneCount, len(keys), keys[i], err)
+				progressMu.Unlock()
+			}
+		}
+	}
+
+	workers := tf.workers
+	if workers > len(keys) {
+		workers = len(keys)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go worker()
+	}
+	for i := range keys {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// tileFetchError formats a per-tile failure for logging.
+func tileFetchError(key TileKey, err error) string {
+	return fmt.Sprintf("tile %d,%d (version %s): %v", key.X, key.Y, key.Version, err)
+}
@@ -10,7 +10,6 @@ import (
 	"image/png"
 	"io"
 	"log"
-	"math"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -30,6 +29,17 @@ type Config struct {
 	OutputFile string
 	CacheDir   string
 	AutoFetch  bool
+	Workers    int
+	Rate       float64
+	Format     string
+	DumpPath   string
+	LoadPath   string
+	RenderOnly bool
+	Resume     bool
+	Palette    string
+	Normalize  string
+	Alpha      bool
+	Overlay    bool
 }
 
 func parseFullsize(fs string) (startX, startY, width, height int, err error) {
@@ -59,8 +69,12 @@ func parseFullsize(fs string) (startX, startY, width, height int, err error) {
 		y1 := vals[1]*TileSize + vals[3]
 		x2 := vals[4]*TileSize + vals[6]
 		y2 := vals[5]*TileSize + vals[7]
-		if x1 > x2 { x1, x2 = x2, x1 }
-		if y1 > y2 { y1, y2 = y2, y1 }
+		if x1 > x2 {
+			x1, x2 = x2, x1
+		}
+		if y1 > y2 {
+			y1, y2 = y2, y1
+		}
 		startX = x1
 		startY = y1
 		width = x2 - x1
@@ -85,8 +99,12 @@ func parseTileRange(tr string) (minTX, minTY, maxTX, maxTY int, err error) {
 	y1, _ := strconv.Atoi(p1[1])
 	x2, _ := strconv.Atoi(p2[0])
 	y2, _ := strconv.Atoi(p2[1])
-	if x1 > x2 { x1, x2 = x2, x1 }
-	if y1 > y2 { y1, y2 = y2, y1 }
+	if x1 > x2 {
+		x1, x2 = x2, x1
+	}
+	if y1 > y2 {
+		y1, y2 = y2, y1
+	}
 	return x1, y1, x2, y2, nil
 }
 
@@ -214,7 +232,7 @@ func interactiveMode() Config {
 	}
 
 	fmt.Println("=== Wplace Heatmap Generator (Interactive Mode) ===")
-	
+
 	fmt.Print("Fetch versions automatically from wplace.eralyon.net? [Y/n]: ")
 	autoStr, _ := reader.ReadString('\n')
 	autoStr = strings.ToLower(strings.TrimSpace(autoStr))
@@ -260,6 +278,11 @@ func interactiveMode() Config {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		runServe(os.Args[2:])
+		return
+	}
+
 	config := Config{}
 	flag.IntVar(&config.Zoom, "zoom", 11, "Zoom level")
 	flag.StringVar(&config.Fullsize, "fullsize", "", "Fullsize range (6 or 8 parts)")
@@ -268,9 +291,44 @@ func main() {
 	flag.StringVar(&config.Versions, "vfile", "versions.txt", "Versions file")
 	flag.StringVar(&config.OutputFile, "out", "heatmap.png", "Output filename")
 	flag.StringVar(&config.CacheDir, "cache", "tile_cache", "Tile cache directory")
+	flag.StringVar(&config.Format, "format", "png", "Output format: png or pmtiles")
 	flag.BoolVar(&config.AutoFetch, "auto", true, "Automatically fetch versions from site")
+	flag.IntVar(&config.Workers, "workers", 4, "Number of concurrent tile fetch workers")
+	flag.Float64Var(&config.Rate, "rate", 0, "Max tile requests per second (0 = unlimited)")
+	flag.StringVar(&config.DumpPath, "dump", "", "Write the per-pixel change matrix to this file after processing")
+	flag.StringVar(&config.LoadPath, "load", "", "Load a previously dumped change matrix from this file")
+	flag.BoolVar(&config.RenderOnly, "render-only", false, "Render output from -load without touching the network")
+	flag.BoolVar(&config.Resume, "resume", false, "Append new versions to the matrix loaded from -load")
+	flag.StringVar(&config.Palette, "palette", "jet", "Colormap: jet, viridis, inferno, magma, or turbo")
+	flag.StringVar(&config.Normalize, "normalize", "linear", "Normalization: linear, log, sqrt, or quantile")
+	flag.BoolVar(&config.Alpha, "alpha", false, "Output RGBA with alpha scaling by intensity")
+	flag.BoolVar(&config.Overlay, "overlay", false, "Composite the heatmap over the last merged version's image")
 	flag.Parse()
 
+	if _, err := colormapByName(config.Palette); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := newNormalizer(config.Normalize, nil, 0); err != nil {
+		log.Fatal(err)
+	}
+	switch config.Format {
+	case "png", "pmtiles":
+	default:
+		log.Fatalf("unknown format %q (want png or pmtiles)", config.Format)
+	}
+
+	if config.RenderOnly {
+		if config.LoadPath == "" {
+			log.Fatalf("-render-only requires -load")
+		}
+		dump, err := loadDump(config.LoadPath)
+		if err != nil {
+			log.Fatalf("Failed to load dump: %v", err)
+		}
+		renderOutput(config, dump.StartAbsX, dump.StartAbsY, dump.Width, dump.Height, dump.Zoom, dump.Changes, nil)
+		return
+	}
+
 	if config.Fullsize == "" && config.TileRange == "" && config.SingleTile == "" && flag.NFlag() == 0 {
 		config = interactiveMode()
 	}
@@ -333,41 +391,99 @@ func main() {
 	maxTileX := (startAbsX + width - 1) / TileSize
 	maxTileY := (startAbsY + height - 1) / TileSize
 
-	changes := make([][]uint32, height)
-	for i := range changes {
-		changes[i] = make([]uint32, width)
+	var changes [][]uint32
+	var processedVersions []DumpVersion
+	processed := make(map[string]bool)
+	var prevCombined *image.RGBA
+
+	fetcher := NewTileFetcher(config.CacheDir, config.Workers, config.Rate)
+	defer fetcher.Close()
+
+	var tileKeys []TileKey
+	for tx := minTileX; tx <= maxTileX; tx++ {
+		for ty := minTileY; ty <= maxTileY; ty++ {
+			tileKeys = append(tileKeys, TileKey{Zoom: config.Zoom, X: tx, Y: ty})
+		}
 	}
 
-	var prevCombined *image.RGBA
-	successCount := 0
+	if config.Resume {
+		if config.LoadPath == "" {
+			log.Fatalf("-resume requires -load")
+		}
+		dump, err := loadDump(config.LoadPath)
+		if err != nil {
+			log.Fatalf("Failed to load dump: %v", err)
+		}
+		if dump.StartAbsX != startAbsX || dump.StartAbsY != startAbsY || dump.Width != width || dump.Height != height || dump.Zoom != config.Zoom {
+			log.Fatalf("-resume geometry mismatch: dump covers %d,%d %dx%d @z%d, requested %d,%d %dx%d @z%d",
+				dump.StartAbsX, dump.StartAbsY, dump.Width, dump.Height, dump.Zoom, startAbsX, startAbsY, width, height, config.Zoom)
+		}
+		changes = dump.Changes
+		processedVersions = dump.Versions
+		for _, pv := range processedVersions {
+			processed[pv.Name] = true
+		}
+		if last := len(processedVersions) - 1; last >= 0 {
+			lastVersion := processedVersions[last]
+			keys := make([]TileKey, len(tileKeys))
+			for i, k := range tileKeys {
+				k.Version = lastVersion.Name
+				keys[i] = k
+			}
+			rebuilt := image.NewRGBA(image.Rect(0, 0, width, height))
+			onProgress := func(done, total int, key TileKey, err error) {
+				fmt.Printf("\rFetching baseline tiles: %d/%d", done, total)
+			}
+			for _, res := range fetcher.FetchBatch(keys, onProgress) {
+				if res.Err != nil {
+					log.Fatalf("-resume: failed to re-fetch baseline version %s: %s", lastVersion.Name, tileFetchError(res.Key, res.Err))
+				}
+				drawTileInto(rebuilt, res.Key.X, res.Key.Y, startAbsX, startAbsY, width, height, res.Img)
+			}
+			if got := hashCombined(rebuilt); got != lastVersion.Hash {
+				log.Printf("Warning: -resume baseline hash mismatch for version %s; continuing anyway", lastVersion.Name)
+			}
+			prevCombined = rebuilt
+		}
+	}
+	if changes == nil {
+		changes = make([][]uint32, height)
+		for i := range changes {
+			changes[i] = make([]uint32, width)
+		}
+	}
+
+	successCount := len(processedVersions)
 
 	fmt.Printf("\nGenerating heatmap: %dx%d px (Tiles %d,%d to %d,%d)\n", width, height, minTileX, minTileY, maxTileX, maxTileY)
 
 	for _, v := range versions {
+		if processed[v] {
+			continue
+		}
 		currentCombined := image.NewRGBA(image.Rect(0, 0, width, height))
-		versionValid := true
-		for tx := minTileX; tx <= maxTileX; tx++ {
-			for ty := minTileY; ty <= maxTileY; ty++ {
-				img, err := downloadMergedTile(v, config.CacheDir, config.Zoom, tx, ty)
-				if err != nil {
-					versionValid = false
-					break
-				}
-				tileRect := image.Rect(tx*TileSize, ty*TileSize, (tx+1)*TileSize, (ty+1)*TileSize)
-				targetRect := image.Rect(startAbsX, startAbsY, startAbsX+width, startAbsY+height)
-				inter := tileRect.Intersect(targetRect)
-				if !inter.Empty() {
-					drawX := inter.Min.X - startAbsX
-					drawY := inter.Min.Y - startAbsY
-					srcX := inter.Min.X - tx*TileSize
-					srcY := inter.Min.Y - ty*TileSize
-					draw.Draw(currentCombined, image.Rect(drawX, drawY, drawX+inter.Dx(), drawY+inter.Dy()), 
-						img, image.Point{srcX, srcY}, draw.Src)
-				}
+		keys := make([]TileKey, len(tileKeys))
+		for i, k := range tileKeys {
+			k.Version = v
+			keys[i] = k
+		}
+
+		okCount := 0
+		onProgress := func(done, total int, key TileKey, err error) {
+			fmt.Printf("\rFetching tiles for %s: %d/%d", v, done, total)
+		}
+		results := fetcher.FetchBatch(keys, onProgress)
+		for _, res := range results {
+			if res.Err != nil {
+				fmt.Printf("\nWarning: %s\n", tileFetchError(res.Key, res.Err))
+				continue
 			}
-			if !versionValid { break }
+			okCount++
+			drawTileInto(currentCombined, res.Key.X, res.Key.Y, startAbsX, startAbsY, width, height, res.Img)
+		}
+		if okCount == 0 {
+			continue
 		}
-		if !versionValid { continue }
 		successCount++
 		fmt.Printf("\rProcessed: %d/%d (%s)", successCount, len(versions), v)
 		if prevCombined != nil {
@@ -380,7 +496,24 @@ func main() {
 			}
 		}
 		prevCombined = currentCombined
+		processedVersions = append(processedVersions, DumpVersion{Name: v, Hash: hashCombined(currentCombined)})
 	}
+	if config.DumpPath != "" {
+		if err := writeDump(config.DumpPath, startAbsX, startAbsY, width, height, config.Zoom, processedVersions, changes); err != nil {
+			log.Fatalf("Failed to write dump: %v", err)
+		}
+		fmt.Printf("\nWrote change matrix dump to %s\n", config.DumpPath)
+	}
+
+	renderOutput(config, startAbsX, startAbsY, width, height, config.Zoom, changes, prevCombined)
+}
+
+// renderOutput normalizes the change-count matrix and writes it out in
+// the requested -format, shared by the normal download path and
+// -render-only, which skips straight here from a loaded dump. baseImage
+// is the last merged version's image, used by -overlay; it is nil when
+// rendering from a dump, since dumps do not store merged images.
+func renderOutput(config Config, startAbsX, startAbsY, width, height, zoom int, changes [][]uint32, baseImage *image.RGBA) {
 	fmt.Println("\nNormalization and saving...")
 	var maxChanges uint32
 	for y := 0; y < height; y++ {
@@ -390,17 +523,57 @@ func main() {
 			}
 		}
 	}
+
+	cm, err := colormapByName(config.Palette)
+	if err != nil {
+		log.Fatal(err)
+	}
+	norm, err := newNormalizer(config.Normalize, changes, maxChanges)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	minTileX := startAbsX / TileSize
+	minTileY := startAbsY / TileSize
+	maxTileX := (startAbsX + width - 1) / TileSize
+	maxTileY := (startAbsY + height - 1) / TileSize
+
+	if config.Format == "pmtiles" {
+		if config.Overlay {
+			log.Printf("Warning: -overlay has no effect with -format pmtiles; writing the heatmap pyramid alone")
+		}
+		if err := writePMTiles(config.OutputFile, changes, maxChanges, startAbsX, startAbsY, width, height, zoom, minTileX, minTileY, maxTileX, maxTileY, cm, norm, config.Alpha); err != nil {
+			log.Fatalf("Failed to write PMTiles archive: %v", err)
+		}
+		fmt.Printf("Done! Saved pyramid to %s (Max changes: %d)\n", config.OutputFile, maxChanges)
+		return
+	}
+
+	useAlpha := config.Alpha || config.Overlay
 	heatmap := image.NewRGBA(image.Rect(0, 0, width, height))
 	for y := 0; y < height; y++ {
 		for x := 0; x < width; x++ {
-			heatmap.Set(x, y, getHeatColor(changes[y][x], maxChanges))
+			heatmap.Set(x, y, renderColor(changes[y][x], maxChanges, cm, norm, useAlpha))
 		}
 	}
+
+	out := image.Image(heatmap)
+	if config.Overlay {
+		if baseImage == nil {
+			log.Printf("Warning: -overlay requested but no base image is available; writing the heatmap alone")
+		} else {
+			composited := image.NewRGBA(baseImage.Bounds())
+			draw.Draw(composited, composited.Bounds(), baseImage, image.Point{}, draw.Src)
+			draw.Draw(composited, composited.Bounds(), heatmap, image.Point{}, draw.Over)
+			out = composited
+		}
+	}
+
 	outFile, err := os.Create(config.OutputFile)
 	if err != nil {
 		log.Fatal(err)
 	}
-	png.Encode(outFile, heatmap)
+	png.Encode(outFile, out)
 	outFile.Close()
 	fmt.Printf("Done! Saved to %s (Max changes: %d)\n", config.OutputFile, maxChanges)
 }
@@ -410,22 +583,3 @@ func colorsEqual(c1, c2 color.Color) bool {
 	r2, g2, b2, a2 := c2.RGBA()
 	return r1 == r2 && g1 == g2 && b1 == b2 && a1 == a2
 }
-
-func getHeatColor(val, max uint32) color.Color {
-	if val == 0 { return color.RGBA{0, 0, 0, 255} }
-	ratio := float64(val) / float64(max)
-	var r, g, b float64
-	if ratio < 0.25 {
-		b = (ratio / 0.25) * 255
-	} else if ratio < 0.5 {
-		b = 255 - ((ratio - 0.25) / 0.25) * 255
-		g = ((ratio - 0.25) / 0.25) * 255
-	} else if ratio < 0.75 {
-		g = 255
-		r = ((ratio - 0.5) / 0.25) * 255
-	} else {
-		r = 255
-		g = 255 - ((ratio - 0.75) / 0.25) * 255
-	}
-	return color.RGBA{uint8(math.Round(r)), uint8(math.Round(g)), uint8(math.Round(b)), 255}
-}
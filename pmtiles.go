@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/png"
+	"math"
+	"os"
+	"sort"
+)
+
+const (
+	pmTileDim         = 256
+	pmMagic           = "PMTiles"
+	pmSpecVersion     = 3
+	pmTileTypePNG     = 2
+	pmCompressionNone = 1
+	pmHeaderSize      = 127
+	pmMaxRootEntries  = 4096 // above this, entries spill into leaf directories
+)
+
+// pmDirEntry is one row of a PMTiles directory: a tile ID (or, for
+// leaf-pointer entries, the first tile ID covered by a leaf directory),
+// how many consecutive tile IDs it covers, and where its bytes live in
+// the tile-data or leaf-directory section.
+type pmDirEntry struct {
+	TileID    uint64
+	RunLength uint32
+	Length    uint32
+	Offset    uint64
+}
+
+// zxyToTileID converts a (z, x, y) slippy tile coordinate into a PMTiles
+// global tile ID: the count of tiles at all lower zoom levels, plus the
+// tile's Hilbert curve index within its own zoom level.
+func zxyToTileID(z uint8, x, y uint32) uint64 {
+	var acc uint64
+	for t := uint8(0); t < z; t++ {
+		acc += uint64(1) << (2 * t)
+	}
+
+	n := uint32(1) << z
+	var rx, ry uint32
+	var d uint64
+	xi, yi := x, y
+	for s := n / 2; s > 0; s /= 2 {
+		if xi&s > 0 {
+			rx = 1
+		} else {
+			rx = 0
+		}
+		if yi&s > 0 {
+			ry = 1
+		} else {
+			ry = 0
+		}
+		d += uint64(s) * uint64(s) * uint64((3*rx)^ry)
+		if ry == 0 {
+			if rx == 1 {
+				xi = s - 1 - xi
+				yi = s - 1 - yi
+			}
+			xi, yi = yi, xi
+		}
+	}
+	return acc + d
+}
+
+// poolMaxBlock downsamples a grid from srcW x srcH to outW x outH by
+// taking the max over each output pixel's source block, used both for
+// the native-to-256 resample (where srcW/outW isn't a whole number,
+// e.g. 1000/256) and for exact 2x2 mip pooling. Block boundaries are
+// scaled by the src/out ratio rather than a fixed block size, so the
+// last block always reaches the final source row/column instead of
+// truncating toward zero.
+func poolMaxBlock(src [][]uint32, srcW, srcH, outW, outH int) [][]uint32 {
+	scaleX := float64(srcW) / float64(outW)
+	scaleY := float64(srcH) / float64(outH)
+	out := make([][]uint32, outH)
+	for oy := 0; oy < outH; oy++ {
+		out[oy] = make([]uint32, outW)
+		y0 := int(float64(oy) * scaleY)
+		y1 := int(float64(oy+1) * scaleY)
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		if y1 > srcH {
+			y1 = srcH
+		}
+		for ox := 0; ox < outW; ox++ {
+			x0 := int(float64(ox) * scaleX)
+			x1 := int(float64(ox+1) * scaleX)
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			if x1 > srcW {
+				x1 = srcW
+			}
+			var m uint32
+			for y := y0; y < y1; y++ {
+				row := src[y]
+				for x := x0; x < x1; x++ {
+					if row[x] > m {
+						m = row[x]
+					}
+				}
+			}
+			out[oy][ox] = m
+		}
+	}
+	return out
+}
+
+// tileToNative extracts the 256x256, max-pooled tile (tx, ty) at the
+// native zoom from the full-resolution changes matrix.
+func tileToNative(changes [][]uint32, startAbsX, startAbsY, width, height, tx, ty int) [][]uint32 {
+	origin := image.Pt(tx*TileSize-startAbsX, ty*TileSize-startAbsY)
+	sub := make([][]uint32, TileSize)
+	for y := 0; y < TileSize; y++ {
+		sub[y] = make([]uint32, TileSize)
+		py := origin.Y + y
+		if py < 0 || py >= height {
+			continue
+		}
+		for x := 0; x < TileSize; x++ {
+			px := origin.X + x
+			if px < 0 || px >= width {
+				continue
+			}
+			sub[y][x] = changes[py][px]
+		}
+	}
+	return poolMaxBlock(sub, TileSize, TileSize, pmTileDim, pmTileDim)
+}
+
+// buildParent combines up to four child tiles at zoom z+1 into their
+// parent at zoom z via 2x2 max-pooling.
+func buildParent(children [4][][]uint32) [][]uint32 {
+	combined := make([][]uint32, pmTileDim*2)
+	for y := range combined {
+		combined[y] = make([]uint32, pmTileDim*2)
+	}
+	// children index: 0=(0,0) 1=(1,0) 2=(0,1) 3=(1,1)
+	place := func(idx, ox, oy int) {
+		c := children[idx]
+		if c == nil {
+			return
+		}
+		for y := 0; y < pmTileDim; y++ {
+			copy(combined[oy+y][ox:ox+pmTileDim], c[y])
+		}
+	}
+	place(0, 0, 0)
+	place(1, pmTileDim, 0)
+	place(2, 0, pmTileDim)
+	place(3, pmTileDim, pmTileDim)
+	return poolMaxBlock(combined, pmTileDim*2, pmTileDim*2, pmTileDim, pmTileDim)
+}
+
+func tileToLon(x, z int) float64 {
+	return float64(x)/math.Exp2(float64(z))*360.0 - 180.0
+}
+
+func tileToLat(y, z int) float64 {
+	n := math.Pi - 2.0*math.Pi*float64(y)/math.Exp2(float64(z))
+	return 180.0 / math.Pi * math.Atan(0.5*(math.Exp(n)-math.Exp(-n)))
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	buf.Write(tmp[:n])
+}
+
+// serializePMDirectory encodes entries (already sorted by TileID) as the
+// PMTiles v3 directory layout: entry count, then delta-encoded tile IDs,
+// run lengths, lengths, and offsets (offset+1, 0 meaning "contiguous
+// with the previous entry") as four parallel varint arrays.
+func serializePMDirectory(entries []pmDirEntry) []byte {
+	var buf bytes.Buffer
+	writeUvarint(&buf, uint64(len(entries)))
+	var prevID uint64
+	for _, e := range entries {
+		writeUvarint(&buf, e.TileID-prevID)
+		prevID = e.TileID
+	}
+	for _, e := range entries {
+		writeUvarint(&buf, uint64(e.RunLength))
+	}
+	for _, e := range entries {
+		writeUvarint(&buf, uint64(e.Length))
+	}
+	var prevEnd uint64
+	for i, e := range entries {
+		if i > 0 && e.Offset == prevEnd {
+			writeUvarint(&buf, 0)
+		} else {
+			writeUvarint(&buf, e.Offset+1)
+		}
+		prevEnd = e.Offset + uint64(e.Length)
+	}
+	return buf.Bytes()
+}
+
+// buildDirectories splits entries into a root directory plus, past
+// pmMaxRootEntries tiles, a set of leaf directories the root points to.
+func buildDirectories(entries []pmDirEntry) (root, leaves []byte) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].TileID < entries[j].TileID })
+	if len(entries) <= pmMaxRootEntries {
+		return serializePMDirectory(entries), nil
+	}
+
+	var leafBuf bytes.Buffer
+	var rootEntries []pmDirEntry
+	for i := 0; i < len(entries); i += pmMaxRootEntries {
+		end := i + pmMaxRootEntries
+		if end > len(entries) {
+			end = len(entries)
+		}
+		group := entries[i:end]
+		leafBytes := serializePMDirectory(group)
+		rootEntries = append(rootEntries, pmDirEntry{
+			TileID:    group[0].TileID,
+			RunLength: 0,
+			Length:    uint32(len(leafBytes)),
+			Offset:    uint64(leafBuf.Len()),
+		})
+		leafBuf.Write(leafBytes)
+	}
+	return serializePMDirectory(rootEntries), leafBuf.Bytes()
+}
+
+// writePMTiles builds a full zoom pyramid of the change-count heatmap
+// down to zoom 0 and packs it into a single-file PMTiles v3 archive.
+func writePMTiles(outPath string, changes [][]uint32, maxChanges uint32, startAbsX, startAbsY, width, height int, nativeZoom, minTileX, minTileY, maxTileX, maxTileY int, cm Colormap, norm Normalizer, alpha bool) error {
+	type tileContent struct {
+		z, x, y int
+		grid    [][]uint32
+	}
+
+	levels := map[int]map[[2]int][][]uint32{nativeZoom: {}}
+	for tx := minTileX; tx <= maxTileX; tx++ {
+		for ty := minTileY; ty <= maxTileY; ty++ {
+			levels[nativeZoom][[2]int{tx, ty}] = tileToNative(changes, startAbsX, startAbsY, width, height, tx, ty)
+		}
+	}
+
+	for z := nativeZoom; z > 0; z-- {
+		parentLevel := map[[2]int][][]uint32{}
+		for key := range levels[z] {
+			px, py := key[0]>>1, key[1]>>1
+			if _, ok := parentLevel[[2]int{px, py}]; ok {
+				continue
+			}
+			var children [4][][]uint32
+			for i, off := range [4][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				children[i] = levels[z][[2]int{px*2 + off[0], py*2 + off[1]}]
+			}
+			parentLevel[[2]int{px, py}] = buildParent(children)
+		}
+		levels[z-1] = parentLevel
+	}
+
+	var tiles []tileContent
+	for z := 0; z <= nativeZoom; z++ {
+		for key, grid := range levels[z] {
+			tiles = append(tiles, tileContent{z: z, x: key[0], y: key[1], grid: grid})
+		}
+	}
+
+	var tileData bytes.Buffer
+	hashOffsets := map[uint64]pmDirEntry{}
+	var entries []pmDirEntry
+	for _, t := range tiles {
+		img := image.NewRGBA(image.Rect(0, 0, pmTileDim, pmTileDim))
+		for y := 0; y < pmTileDim; y++ {
+			for x := 0; x < pmTileDim; x++ {
+				img.Set(x, y, renderColor(t.grid[y][x], maxChanges, cm, norm, alpha))
+			}
+		}
+		var pngBuf bytes.Buffer
+		if err := png.Encode(&pngBuf, img); err != nil {
+			return fmt.Errorf("encode tile %d/%d/%d: %w", t.z, t.x, t.y, err)
+		}
+		h := fnv.New64a()
+		h.Write(pngBuf.Bytes())
+		sum := h.Sum64()
+
+		tileID := zxyToTileID(uint8(t.z), uint32(t.x), uint32(t.y))
+		if existing, ok := hashOffsets[sum]; ok {
+			entries = append(entries, pmDirEntry{TileID: tileID, RunLength: 1, Length: existing.Length, Offset: existing.Offset})
+			continue
+		}
+		entry := pmDirEntry{TileID: tileID, RunLength: 1, Length: uint32(pngBuf.Len()), Offset: uint64(tileData.Len())}
+		hashOffsets[sum] = entry
+		entries = append(entries, entry)
+		tileData.Write(pngBuf.Bytes())
+	}
+
+	rootDir, leafDirs := buildDirectories(entries)
+
+	metadata, _ := json.Marshal(map[string]interface{}{
+		"name":    "wplace-heatmap",
+		"format":  "png",
+		"minzoom": 0,
+		"maxzoom": nativeZoom,
+	})
+
+	minLon := tileToLon(minTileX, nativeZoom)
+	maxLon := tileToLon(maxTileX+1, nativeZoom)
+	minLat := tileToLat(maxTileY+1, nativeZoom)
+	maxLat := tileToLat(minTileY, nativeZoom)
+	centerLon := (minLon + maxLon) / 2
+	centerLat := (minLat + maxLat) / 2
+
+	rootDirOffset := uint64(pmHeaderSize)
+	metadataOffset := rootDirOffset + uint64(len(rootDir))
+	leafDirsOffset := metadataOffset + uint64(len(metadata))
+	tileDataOffset := leafDirsOffset + uint64(len(leafDirs))
+
+	var addressedTiles uint64
+	for _, e := range entries {
+		addressedTiles += uint64(e.RunLength)
+	}
+
+	header := new(bytes.Buffer)
+	header.WriteString(pmMagic)
+	header.WriteByte(pmSpecVersion)
+	writeUint64 := func(v uint64) { binary.Write(header, binary.LittleEndian, v) }
+	writeInt32 := func(v int32) { binary.Write(header, binary.LittleEndian, v) }
+	writeUint64(rootDirOffset)
+	writeUint64(uint64(len(rootDir)))
+	writeUint64(metadataOffset)
+	writeUint64(uint64(len(metadata)))
+	writeUint64(leafDirsOffset)
+	writeUint64(uint64(len(leafDirs)))
+	writeUint64(tileDataOffset)
+	writeUint64(uint64(tileData.Len()))
+	writeUint64(addressedTiles)
+	writeUint64(uint64(len(entries)))
+	writeUint64(uint64(len(hashOffsets)))
+	header.WriteByte(0) // clustered: tile data is not guaranteed sorted by tile ID
+	header.WriteByte(pmCompressionNone)
+	header.WriteByte(pmCompressionNone)
+	header.WriteByte(pmTileTypePNG)
+	header.WriteByte(0) // min_zoom
+	header.WriteByte(byte(nativeZoom))
+	writeInt32(int32(math.Round(minLon * 1e7)))
+	writeInt32(int32(math.Round(minLat * 1e7)))
+	writeInt32(int32(math.Round(maxLon * 1e7)))
+	writeInt32(int32(math.Round(maxLat * 1e7)))
+	header.WriteByte(byte(nativeZoom / 2))
+	writeInt32(int32(math.Round(centerLon * 1e7)))
+	writeInt32(int32(math.Round(centerLat * 1e7)))
+
+	if header.Len() != pmHeaderSize {
+		return fmt.Errorf("internal error: pmtiles header is %d bytes, want %d", header.Len(), pmHeaderSize)
+	}
+
+	f, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, chunk := range [][]byte{header.Bytes(), rootDir, metadata, leafDirs, tileData.Bytes()} {
+		if _, err := f.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
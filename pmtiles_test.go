@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestZxyToTileIDMatchesKnownValues(t *testing.T) {
+	if got := zxyToTileID(0, 0, 0); got != 0 {
+		t.Fatalf("z0: got %d, want 0", got)
+	}
+	// Zoom 1 has 4 tiles, with IDs 1..4 following zoom 0's single tile.
+	seen := make(map[uint64]bool)
+	for x := uint32(0); x < 2; x++ {
+		for y := uint32(0); y < 2; y++ {
+			id := zxyToTileID(1, x, y)
+			if id < 1 || id > 4 {
+				t.Fatalf("zxyToTileID(1, %d, %d) = %d, want in [1,4]", x, y, id)
+			}
+			if seen[id] {
+				t.Fatalf("zxyToTileID(1, %d, %d) = %d collides with another tile", x, y, id)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func TestPoolMaxBlock(t *testing.T) {
+	src := [][]uint32{
+		{1, 2, 3, 4},
+		{5, 6, 7, 8},
+	}
+	got := poolMaxBlock(src, 4, 2, 2, 1)
+	want := [][]uint32{{6, 8}}
+	for y := range want {
+		for x := range want[y] {
+			if got[y][x] != want[y][x] {
+				t.Fatalf("poolMaxBlock()[%d][%d] = %d, want %d", y, x, got[y][x], want[y][x])
+			}
+		}
+	}
+}
+
+func TestTileToNativeCoversFullTileRange(t *testing.T) {
+	width, height := TileSize, TileSize
+	changes := make([][]uint32, height)
+	for y := range changes {
+		changes[y] = make([]uint32, width)
+	}
+	changes[999][999] = 9999
+
+	native := tileToNative(changes, 0, 0, width, height, 0, 0)
+	var max uint32
+	for _, row := range native {
+		for _, v := range row {
+			if v > max {
+				max = v
+			}
+		}
+	}
+	if max != 9999 {
+		t.Fatalf("tileToNative dropped the hotspot past column/row 768: got max %d, want 9999", max)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// heatmapServer keeps the change-count matrix in memory and re-renders
+// individual tiles on demand instead of writing one giant PNG.
+type heatmapServer struct {
+	startAbsX, startAbsY int
+	width, height        int
+	zoom                 int
+	minTileX, minTileY   int
+	maxTileX, maxTileY   int
+	fetcher              *TileFetcher
+	colormap             Colormap
+	normalizeMode        string
+	alpha                bool
+
+	mu                sync.RWMutex
+	changes           [][]uint32
+	maxChanges        uint32
+	normalizer        Normalizer
+	prevCombined      *image.RGBA
+	versionsProcessed int
+	seenVersions      map[string]bool
+}
+
+func newHeatmapServer(startAbsX, startAbsY, width, height, zoom int, fetcher *TileFetcher, cm Colormap, normalizeMode string, alpha bool) *heatmapServer {
+	changes := make([][]uint32, height)
+	for i := range changes {
+		changes[i] = make([]uint32, width)
+	}
+	return &heatmapServer{
+		startAbsX:     startAbsX,
+		startAbsY:     startAbsY,
+		width:         width,
+		height:        height,
+		zoom:          zoom,
+		minTileX:      startAbsX / TileSize,
+		minTileY:      startAbsY / TileSize,
+		maxTileX:      (startAbsX + width - 1) / TileSize,
+		maxTileY:      (startAbsY + height - 1) / TileSize,
+		fetcher:       fetcher,
+		colormap:      cm,
+		normalizeMode: normalizeMode,
+		alpha:         alpha,
+		changes:       changes,
+		normalizer:    linearNormalizer{},
+		seenVersions:  make(map[string]bool),
+	}
+}
+
+// ingestVersion downloads every tile covering the server's bounds for
+// version v, diffs it against the previously ingested version, and
+// folds the result into the change matrix.
+func (s *heatmapServer) ingestVersion(v string) error {
+	var keys []TileKey
+	for tx := s.minTileX; tx <= s.maxTileX; tx++ {
+		for ty := s.minTileY; ty <= s.maxTileY; ty++ {
+			keys = append(keys, TileKey{Version: v, Zoom: s.zoom, X: tx, Y: ty})
+		}
+	}
+
+	current := image.NewRGBA(image.Rect(0, 0, s.width, s.height))
+	onProgress := func(done, total int, key TileKey, err error) {
+		if done == total || done%50 == 0 {
+			log.Printf("serve: ingest %s: %d/%d tiles fetched", v, done, total)
+		}
+	}
+	results := s.fetcher.FetchBatch(keys, onProgress)
+	okCount := 0
+	for _, res := range results {
+		if res.Err != nil {
+			log.Printf("serve: %s", tileFetchError(res.Key, res.Err))
+			continue
+		}
+		okCount++
+		tx, ty := res.Key.X, res.Key.Y
+		tileRect := image.Rect(tx*TileSize, ty*TileSize, (tx+1)*TileSize, (ty+1)*TileSize)
+		targetRect := image.Rect(s.startAbsX, s.startAbsY, s.startAbsX+s.width, s.startAbsY+s.height)
+		inter := tileRect.Intersect(targetRect)
+		if inter.Empty() {
+			continue
+		}
+		drawX := inter.Min.X - s.startAbsX
+		drawY := inter.Min.Y - s.startAbsY
+		srcX := inter.Min.X - tx*TileSize
+		srcY := inter.Min.Y - ty*TileSize
+		drawInto(current, drawX, drawY, res.Img, srcX, srcY, inter.Dx(), inter.Dy())
+	}
+	if okCount == 0 {
+		return fmt.Errorf("version %s: all tiles failed", v)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.prevCombined != nil {
+		for y := 0; y < s.height; y++ {
+			for x := 0; x < s.width; x++ {
+				if !colorsEqual(current.At(x, y), s.prevCombined.At(x, y)) {
+					s.changes[y][x]++
+					if s.changes[y][x] > s.maxChanges {
+						s.maxChanges = s.changes[y][x]
+					}
+				}
+			}
+		}
+	}
+	s.prevCombined = current
+	norm, err := newNormalizer(s.normalizeMode, s.changes, s.maxChanges)
+	if err != nil {
+		return err
+	}
+	s.normalizer = norm
+	s.versionsProcessed++
+	s.seenVersions[v] = true
+	return nil
+}
+
+// poll re-fetches the version list and ingests anything not already seen.
+func (s *heatmapServer) poll(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		versions, err := fetchVersionsFromSite()
+		if err != nil {
+			log.Printf("serve: poll failed: %v", err)
+			continue
+		}
+		for _, v := range versions {
+			s.mu.RLock()
+			seen := s.seenVersions[v]
+			s.mu.RUnlock()
+			if seen {
+				continue
+			}
+			if err := s.ingestVersion(v); err != nil {
+				log.Printf("serve: ingest %s: %v", v, err)
+			} else {
+				log.Printf("serve: ingested version %s", v)
+			}
+		}
+	}
+}
+
+func (s *heatmapServer) handleTile(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/heat/")
+	path = strings.TrimSuffix(path, ".png")
+	parts := strings.Split(path, "/")
+	if len(parts) != 3 {
+		http.NotFound(w, r)
+		return
+	}
+	z, err1 := strconv.Atoi(parts[0])
+	x, err2 := strconv.Atoi(parts[1])
+	y, err3 := strconv.Atoi(parts[2])
+	if err1 != nil || err2 != nil || err3 != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if z != s.zoom || x < s.minTileX || x > s.maxTileX || y < s.minTileY || y > s.maxTileY {
+		http.NotFound(w, r)
+		return
+	}
+
+	tile := image.NewRGBA(image.Rect(0, 0, TileSize, TileSize))
+	baseX := x*TileSize - s.startAbsX
+	baseY := y*TileSize - s.startAbsY
+	for ty := 0; ty < TileSize; ty++ {
+		py := baseY + ty
+		if py < 0 || py >= s.height {
+			continue
+		}
+		for tx := 0; tx < TileSize; tx++ {
+			px := baseX + tx
+			if px < 0 || px >= s.width {
+				continue
+			}
+			tile.Set(tx, ty, renderColor(s.changes[py][px], s.maxChanges, s.colormap, s.normalizer, s.alpha))
+		}
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	png.Encode(w, tile)
+}
+
+func (s *heatmapServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"maxChanges":   s.maxChanges,
+		"versionCount": s.versionsProcessed,
+		"zoom":         s.zoom,
+		"minTileX":     s.minTileX,
+		"minTileY":     s.minTileY,
+		"maxTileX":     s.maxTileX,
+		"maxTileY":     s.maxTileY,
+	})
+}
+
+func (s *heatmapServer) handleIndex(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>wplace heatmap</title>
+<link rel="stylesheet" href="https://unpkg.com/leaflet@1.9.4/dist/leaflet.css" />
+<script src="https://unpkg.com/leaflet@1.9.4/dist/leaflet.js"></script>
+<style>#map { position: absolute; top: 0; bottom: 0; width: 100%%; } body { margin: 0; }</style>
+</head>
+<body>
+<div id="map"></div>
+<script>
+// Tiles only exist at zoom %d, so zooming is disabled rather than left to 404.
+var map = L.map('map', {
+	crs: L.CRS.Simple, minZoom: %d, maxZoom: %d,
+	zoomControl: false, scrollWheelZoom: false, doubleClickZoom: false, boxZoom: false, touchZoom: false,
+}).setView([0, 0], %d);
+L.tileLayer('/heat/{z}/{x}/{y}.png', { tileSize: %d, noWrap: true }).addTo(map);
+</script>
+</body>
+</html>`, s.zoom, s.zoom, s.zoom, s.zoom, TileSize)
+}
+
+func drawInto(dst *image.RGBA, dstX, dstY int, src image.Image, srcX, srcY, w, h int) {
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dst.Set(dstX+x, dstY+y, src.At(srcX+x, srcY+y))
+		}
+	}
+}
+
+// runServe implements the `serve` subcommand, exposing the change-count
+// grid over HTTP instead of writing a single heatmap.png.
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", ":8080", "HTTP listen address")
+	zoom := fs.Int("zoom", 11, "Zoom level")
+	fullsize := fs.String("fullsize", "", "Fullsize range (6 or 8 parts)")
+	tileRange := fs.String("tiles", "", "Tile range mode (minX-minY_maxX-maxY)")
+	singleTile := fs.String("tile", "", "Single tile mode (tileX-tileY)")
+	vfile := fs.String("vfile", "versions.txt", "Versions file")
+	cacheDir := fs.String("cache", "tile_cache", "Tile cache directory")
+	autoFetch := fs.Bool("auto", true, "Automatically fetch versions from site")
+	workers := fs.Int("workers", 4, "Number of concurrent tile fetch workers")
+	rate := fs.Float64("rate", 0, "Max tile requests per second (0 = unlimited)")
+	poll := fs.Duration("poll", 60*time.Second, "Interval to poll wplace.eralyon.net for new versions")
+	palette := fs.String("palette", "jet", "Colormap: jet, viridis, inferno, magma, or turbo")
+	normalize := fs.String("normalize", "linear", "Normalization: linear, log, sqrt, or quantile")
+	alpha := fs.Bool("alpha", false, "Render transparent background for overlaying on base tiles")
+	fs.Parse(args)
+
+	cm, err := colormapByName(*palette)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := newNormalizer(*normalize, nil, 0); err != nil {
+		log.Fatal(err)
+	}
+
+	var startAbsX, startAbsY, width, height int
+	switch {
+	case *fullsize != "":
+		startAbsX, startAbsY, width, height, err = parseFullsize(*fullsize)
+	case *tileRange != "":
+		var minTX, minTY, maxTX, maxTY int
+		minTX, minTY, maxTX, maxTY, err = parseTileRange(*tileRange)
+		if err == nil {
+			startAbsX = minTX * TileSize
+			startAbsY = minTY * TileSize
+			width = (maxTX - minTX + 1) * TileSize
+			height = (maxTY - minTY + 1) * TileSize
+		}
+	case *singleTile != "":
+		parts := strings.Split(*singleTile, "-")
+		if len(parts) != 2 {
+			log.Fatalf("Invalid single tile format: %s", *singleTile)
+		}
+		tx, _ := strconv.Atoi(parts[0])
+		ty, _ := strconv.Atoi(parts[1])
+		startAbsX = tx * TileSize
+		startAbsY = ty * TileSize
+		width = TileSize
+		height = TileSize
+	default:
+		startAbsX = 1818 * TileSize
+		startAbsY = 806 * TileSize
+		width = TileSize
+		height = TileSize
+	}
+	if err != nil {
+		log.Fatalf("Parse error: %v", err)
+	}
+
+	var versions []string
+	if *autoFetch {
+		versions, err = fetchVersionsFromSite()
+		if err != nil {
+			log.Printf("Warning: auto-fetch failed: %v. Falling back to file.", err)
+			versions, err = readVersions(*vfile)
+		}
+	} else {
+		versions, err = readVersions(*vfile)
+	}
+	if err != nil {
+		log.Fatalf("Failed to load versions: %v", err)
+	}
+
+	fetcher := NewTileFetcher(*cacheDir, *workers, *rate)
+	server := newHeatmapServer(startAbsX, startAbsY, width, height, *zoom, fetcher, cm, *normalize, *alpha)
+
+	log.Printf("Ingesting %d known versions...", len(versions))
+	for _, v := range versions {
+		if err := server.ingestVersion(v); err != nil {
+			log.Printf("serve: ingest %s: %v", v, err)
+		}
+	}
+
+	go server.poll(*poll)
+
+	http.HandleFunc("/", server.handleIndex)
+	http.HandleFunc("/heat/", server.handleTile)
+	http.HandleFunc("/stats", server.handleStats)
+
+	log.Printf("Serving heatmap on %s (zoom %d, tiles %d,%d to %d,%d)", *addr, *zoom, server.minTileX, server.minTileY, server.maxTileX, server.maxTileY)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}